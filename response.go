@@ -2,26 +2,102 @@ package gear
 
 import (
 	"bufio"
+	"io"
 	"net"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+type encoderEntry struct {
+	level int
+	ctor  func(io.Writer, int) io.WriteCloser
+}
+
+var (
+	encoderRegistryMu sync.RWMutex
+	encoderRegistry   = map[string]encoderEntry{}
+)
+
+// RegisterEncoder registers a content-coding (e.g. "gzip", "deflate", "br",
+// "zstd") so that Response.Negotiate can select it based on the request's
+// Accept-Encoding header. level is passed through to ctor on every call, so
+// encoders that support tunable compression levels (e.g.
+// gzip.NewWriterLevel) can honor it. RegisterEncoder is safe to call
+// concurrently with in-flight requests, but is normally only called from
+// package init.
+func RegisterEncoder(name string, level int, ctor func(io.Writer, int) io.WriteCloser) {
+	encoderRegistryMu.Lock()
+	defer encoderRegistryMu.Unlock()
+	encoderRegistry[name] = encoderEntry{level: level, ctor: ctor}
+}
+
+func lookupEncoder(name string) (encoderEntry, bool) {
+	encoderRegistryMu.RLock()
+	defer encoderRegistryMu.RUnlock()
+	entry, ok := encoderRegistry[name]
+	return entry, ok
+}
+
+func registeredEncoderNames() []string {
+	encoderRegistryMu.RLock()
+	defer encoderRegistryMu.RUnlock()
+	names := make([]string, 0, len(encoderRegistry))
+	for name := range encoderRegistry {
+		names = append(names, name)
+	}
+	return names
+}
+
+// encodingResponseWriter wraps an http.ResponseWriter so that Write calls are
+// streamed through the content-coding negotiated by Response.Negotiate.
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	encoder io.WriteCloser
+}
+
+func (w *encodingResponseWriter) Write(buf []byte) (int, error) {
+	return w.encoder.Write(buf)
+}
+
 var defaultHeaderFilterReg = regexp.MustCompile(
-	`(?i)^(accept|allow|retry-after|warning|vary|access-control-allow-|x-ratelimit-)`)
+	`(?i)^(accept|allow|retry-after|warning|vary|access-control-allow-|x-ratelimit-|trailer)|^` +
+		regexp.QuoteMeta(http.TrailerPrefix))
 
 // Response wraps an http.ResponseWriter and implements its interface to be used
 // by an HTTP handler to construct an HTTP response.
 type Response struct {
 	status      int    // response Status Code
 	body        []byte // the response content.
+	size        int64  // bytes of body already written to the connection
+	beforeHooks []func()
 	afterHooks  []func()
 	endHooks    []func()
 	ended       atomicBool // indicate that app middlewares run out.
 	wroteHeader atomicBool
 	w           http.ResponseWriter // the origin http.ResponseWriter, should not be override.
 	rw          http.ResponseWriter // maybe a http.ResponseWriter wrapper
+	req         *http.Request       // the incoming request, used by Negotiate
+	encoding    string              // content-coding selected by Negotiate, if any
+	encoder     io.WriteCloser      // non-nil once WriteHeader has wrapped rw with it
+	closed      atomicBool          // guards Close running more than once
+}
+
+// NewResponse creates a Response that wraps w to build the reply to req. This
+// is the constructor the framework calls once per incoming request; req is
+// kept so Negotiate can read the request's Accept-Encoding header.
+func NewResponse(w http.ResponseWriter, req *http.Request) *Response {
+	return &Response{w: w, rw: w, req: req}
 }
 
 // Get gets the first value associated with the given key. If there are no values associated with the key, Get returns "". To access multiple values of a key, access the map directly with CanonicalHeaderKey.
@@ -51,6 +127,75 @@ func (r *Response) Vary(field string) {
 	}
 }
 
+// Negotiate parses the request's Accept-Encoding header and returns the
+// best-supported content-coding among encodings (or, if encodings is empty,
+// among every name passed to RegisterEncoder), honoring q-values (a coding
+// with q=0 is never chosen). The weight given to "identity" does not affect
+// the result: "identity;q=0" still yields "" when no listed coding is
+// acceptable. The winning encoding is remembered on r so that
+// WriteHeader wraps the response writer with the matching encoder; it
+// returns "" when no acceptable encoding is available.
+func (r *Response) Negotiate(encodings ...string) string {
+	if r.req == nil {
+		return ""
+	}
+	accept := r.req.Header.Get(HeaderAcceptEncoding)
+	if accept == "" {
+		return ""
+	}
+	if len(encodings) == 0 {
+		encodings = registeredEncoderNames()
+	}
+
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		name, q := parseEncodingQ(part)
+		if name != "" {
+			weights[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range encodings {
+		if _, ok := lookupEncoder(name); !ok {
+			continue
+		}
+		q, ok := weights[name]
+		if !ok {
+			if q, ok = weights["*"]; !ok {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	r.encoding = best
+	return best
+}
+
+// parseEncodingQ parses a single Accept-Encoding list element such as
+// "gzip;q=0.8" into its lower-cased coding name and q-value (1 when absent).
+func parseEncodingQ(part string) (string, float64) {
+	part = strings.TrimSpace(part)
+	if part == "" {
+		return "", 0
+	}
+	name, q := part, 1.0
+	if i := strings.IndexByte(part, ';'); i >= 0 {
+		name = part[:i]
+		for _, p := range strings.Split(part[i+1:], ";") {
+			p = strings.TrimSpace(p)
+			if v, ok := strings.CutPrefix(p, "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(name)), q
+}
+
 // Status returns the current status code.
 func (r *Response) Status() int {
 	return r.status
@@ -81,6 +226,26 @@ func (r *Response) ResetHeader(filterReg ...*regexp.Regexp) {
 	}
 }
 
+// DeclareTrailer announces the given header keys as HTTP trailers by
+// appending them to the Trailer header, so SetTrailer can set their values
+// after the body has been streamed. It is a no-op once the header has
+// already been committed.
+func (r *Response) DeclareTrailer(keys ...string) {
+	if r.wroteHeader.isTrue() {
+		return
+	}
+	for _, key := range keys {
+		r.Header().Add(HeaderTrailer, http.CanonicalHeaderKey(key))
+	}
+}
+
+// SetTrailer sets a trailer value to be emitted after the body, using the
+// http.TrailerPrefix convention so it can be set any time before the handler
+// returns, even after the header has been committed and the body streamed.
+func (r *Response) SetTrailer(key, value string) {
+	r.Header().Set(http.TrailerPrefix+key, value)
+}
+
 // Header returns the header map that will be sent by WriteHeader.
 func (r *Response) Header() http.Header {
 	return r.rw.Header()
@@ -95,7 +260,48 @@ func (r *Response) Write(buf []byte) (int, error) {
 		}
 		r.WriteHeader(0)
 	}
-	return r.rw.Write(buf)
+	n, err := r.rw.Write(buf)
+	r.size += int64(n)
+	return n, err
+}
+
+// ReadFrom implements io.ReaderFrom so that io.Copy(response, src) can take
+// the underlying http.ResponseWriter's sendfile/zero-copy fast path (as
+// net/http's response does via *net.TCPConn.ReadFrom) instead of falling
+// back to a generic buffered loop.
+func (r *Response) ReadFrom(src io.Reader) (n int64, err error) {
+	// Some http Handler will call ReadFrom directly.
+	if !r.wroteHeader.isTrue() {
+		if r.status == 0 {
+			r.status = 200
+		}
+		r.WriteHeader(0)
+	}
+	if rf, ok := r.rw.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		buf := copyBufPool.Get().(*[]byte)
+		n, err = io.CopyBuffer(r.rw, src, *buf)
+		copyBufPool.Put(buf)
+	}
+	r.size += n
+	return n, err
+}
+
+// Size returns the number of body bytes handed to the connection so far. If a
+// content-coding was negotiated via Negotiate, this is the uncompressed byte
+// count accepted by Write, not the number of compressed bytes sent on the
+// wire.
+func (r *Response) Size() int64 {
+	return r.size
+}
+
+// Committed indicates that whether at least one body byte has been written.
+// Unlike HeaderWrote, which only means WriteHeader has been called,
+// Committed lets logging/metrics middleware distinguish a status-only
+// response (e.g. 204) from one whose body has actually started streaming.
+func (r *Response) Committed() bool {
+	return r.size > 0
 }
 
 // WriteHeader sends an HTTP response header with status code.
@@ -109,11 +315,15 @@ func (r *Response) WriteHeader(code int) {
 	// ensure that ended is true
 	r.ended.setTrue()
 
-	// set status before afterHooks
+	// set status before beforeHooks/afterHooks
 	if code > 0 {
 		r.status = code
 	}
 
+	// execute "before hooks" with LIFO order before afterHooks and the
+	// status/Content-Length checks below
+	runHooks(r.beforeHooks)
+
 	// execute "after hooks" with LIFO order before Response.WriteHeader
 	runHooks(r.afterHooks)
 
@@ -134,6 +344,21 @@ func (r *Response) WriteHeader(code int) {
 	if r.body != nil {
 		r.Set(HeaderContentLength, strconv.Itoa(len(r.body)))
 	}
+
+	// wrap rw with the negotiated encoder, if any; empty-body statuses
+	// (204, 304, ...) never carry a compressible body.
+	if r.encoding != "" && !isEmptyStatus(r.status) {
+		if entry, ok := lookupEncoder(r.encoding); ok {
+			r.Del(HeaderContentLength)
+			r.Set(HeaderContentEncoding, r.encoding)
+			r.Vary(HeaderAcceptEncoding)
+			r.encoder = entry.ctor(r.rw, entry.level)
+			r.rw = &encodingResponseWriter{ResponseWriter: r.rw, encoder: r.encoder}
+			// Close must run once every write is done, which WriteHeader
+			// cannot know on its own; see Response.Close.
+		}
+	}
+
 	r.rw.WriteHeader(r.status)
 	// execute "end hooks" with LIFO order after Response.WriteHeader.
 	// they run in a goroutine, in order to not block current process.
@@ -142,10 +367,24 @@ func (r *Response) WriteHeader(code int) {
 	}
 }
 
+// BeforeWrite registers fn to run, in LIFO order, immediately before the
+// response header is committed by WriteHeader and before afterHooks run.
+// Unlike afterHooks, which are already logically "commit" hooks, BeforeWrite
+// is meant for middleware that must synchronously mutate headers/status based
+// on the final body (ETag, CSRF cookies, conditional-GET), and is guaranteed
+// to run exactly once even when a downstream handler calls Write directly.
+func (r *Response) BeforeWrite(fn func()) {
+	r.beforeHooks = append(r.beforeHooks, fn)
+}
+
 // Flush implements the http.Flusher interface to allow an HTTP handler to flush
-// buffered data to the client.
+// buffered data to the client. If a content-coding was negotiated, the
+// encoder is flushed first so data it is still holding onto reaches the wire.
 // See [http.Flusher](https://golang.org/pkg/net/http/#Flusher)
 func (r *Response) Flush() {
+	if flusher, ok := r.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
 	r.w.(http.Flusher).Flush()
 }
 
@@ -174,6 +413,41 @@ func (r *Response) Push(target string, opts *http.PushOptions) error {
 	return Err.WithMsg("http.Pusher not implemented")
 }
 
+// SetReadDeadline sets the deadline for reading the remainder of the request
+// body, letting handlers extend the server's default timeouts for
+// long-running streams (SSE, large uploads) without disabling them
+// server-wide. It requires the underlying http.ResponseWriter to support
+// http.ResponseController (Go 1.20+).
+func (r *Response) SetReadDeadline(deadline time.Time) error {
+	if err := http.NewResponseController(r.w).SetReadDeadline(deadline); err != nil {
+		return Err.WithMsg("http.ResponseController: SetReadDeadline not supported: " + err.Error())
+	}
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for writing the response, letting
+// handlers extend the server's default timeouts for long-running streams.
+// It requires the underlying http.ResponseWriter to support
+// http.ResponseController (Go 1.20+).
+func (r *Response) SetWriteDeadline(deadline time.Time) error {
+	if err := http.NewResponseController(r.w).SetWriteDeadline(deadline); err != nil {
+		return Err.WithMsg("http.ResponseController: SetWriteDeadline not supported: " + err.Error())
+	}
+	return nil
+}
+
+// EnableFullDuplex indicates that the request handler will interleave reads
+// from the request body with writes to the response, for protocols such as
+// WebTransport that need full-duplex HTTP/1.1 connections. It requires the
+// underlying http.ResponseWriter to support http.ResponseController (Go
+// 1.20+).
+func (r *Response) EnableFullDuplex() error {
+	if err := http.NewResponseController(r.w).EnableFullDuplex(); err != nil {
+		return Err.WithMsg("http.ResponseController: EnableFullDuplex not supported: " + err.Error())
+	}
+	return nil
+}
+
 // HeaderWrote indecates that whether the reply header has been (logically) written.
 func (r *Response) HeaderWrote() bool {
 	return r.wroteHeader.isTrue()
@@ -186,9 +460,31 @@ func (r *Response) respond(status int, body []byte) (err error) {
 	if r.body != nil {
 		_, err = r.Write(r.body)
 	}
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	// any trailers set via SetTrailer after this point are flushed by
+	// net/http once the handler returns.
 	return
 }
 
+// Close finalizes the response once every Write/ReadFrom call for this
+// request is done. respond calls it automatically; a handler that streams
+// the body itself via direct Write/ReadFrom calls (bypassing respond, e.g.
+// SSE or long-poll) must call it exactly once after its last write. It is
+// idempotent and the only place the encoder negotiated by Negotiate is
+// closed, so its trailing buffered bytes/checksum/footer reach the client
+// instead of being silently dropped or raced against in a goroutine.
+func (r *Response) Close() error {
+	if !r.closed.swapTrue() {
+		return nil
+	}
+	if r.encoder != nil {
+		return r.encoder.Close()
+	}
+	return nil
+}
+
 func runHooks(hooks []func()) {
 	// run hooks in LIFO order
 	for i := len(hooks) - 1; i >= 0; i-- {
@@ -0,0 +1,240 @@
+package gear
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseBeforeWriteAndAfterHooksOrder(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := &Response{w: rec, rw: rec}
+
+	var order []string
+	res.BeforeWrite(func() { order = append(order, "before1") })
+	res.BeforeWrite(func() { order = append(order, "before2") })
+	res.afterHooks = append(res.afterHooks,
+		func() { order = append(order, "after1") },
+		func() { order = append(order, "after2") },
+	)
+
+	res.WriteHeader(http.StatusOK)
+
+	want := []string{"before2", "before1", "after2", "after1"}
+	if len(order) != len(want) {
+		t.Fatalf("runHooks order = %v, want %v", order, want)
+	}
+	for i, v := range want {
+		if order[i] != v {
+			t.Fatalf("runHooks order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestResponseBeforeWriteRunsOnceOnDirectWrite(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := &Response{w: rec, rw: rec}
+
+	calls := 0
+	res.BeforeWrite(func() { calls++ })
+
+	if _, err := res.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	res.WriteHeader(http.StatusOK) // no-op, header already committed
+
+	if calls != 1 {
+		t.Fatalf("BeforeWrite hook ran %d times, want 1", calls)
+	}
+}
+
+func TestResponseSizeAndCommitted(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := &Response{w: rec, rw: rec}
+
+	if res.Committed() {
+		t.Fatal("Committed() = true before any write")
+	}
+
+	n, err := res.Write([]byte("hello world"))
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if int64(n) != res.Size() {
+		t.Fatalf("Size() = %d, want %d", res.Size(), n)
+	}
+	if !res.Committed() {
+		t.Fatal("Committed() = false after a write")
+	}
+}
+
+func TestResponseReadFromCountsSize(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := &Response{w: rec, rw: rec}
+
+	n, err := res.ReadFrom(newStringReaderNoFrom("streamed body"))
+	if err != nil {
+		t.Fatalf("ReadFrom: %v", err)
+	}
+	if n != res.Size() {
+		t.Fatalf("Size() = %d, want %d", res.Size(), n)
+	}
+	if rec.Body.String() != "streamed body" {
+		t.Fatalf("recorded body = %q, want %q", rec.Body.String(), "streamed body")
+	}
+}
+
+// stringReaderNoFrom deliberately does not implement io.WriterTo, so
+// io.CopyBuffer in Response.ReadFrom exercises the pooled-buffer fallback
+// path rather than a direct src.WriteTo(dst) shortcut.
+type stringReaderNoFrom struct {
+	s string
+	i int
+}
+
+func newStringReaderNoFrom(s string) *stringReaderNoFrom {
+	return &stringReaderNoFrom{s: s}
+}
+
+func (r *stringReaderNoFrom) Read(p []byte) (int, error) {
+	if r.i >= len(r.s) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.s[r.i:])
+	r.i += n
+	return n, nil
+}
+
+func TestDefaultHeaderFilterRegPreservesTrailers(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := &Response{w: rec, rw: rec}
+
+	res.DeclareTrailer("Checksum")
+	res.SetTrailer("Checksum", "deadbeef")
+	res.Set(HeaderContentType, "text/plain")
+
+	res.ResetHeader()
+
+	if got := res.Get(HeaderContentType); got != "" {
+		t.Fatalf("Content-Type survived ResetHeader: %q", got)
+	}
+	if got := res.Get(HeaderTrailer); got != "Checksum" {
+		t.Fatalf("Trailer header dropped by ResetHeader: %q", got)
+	}
+	if got := res.Header().Get(http.TrailerPrefix + "Checksum"); got != "deadbeef" {
+		t.Fatalf("Trailer: prefixed header dropped by ResetHeader: %q", got)
+	}
+}
+
+func TestResponseNegotiate(t *testing.T) {
+	RegisterEncoder("gzip", 5, newGzipEncoder)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderAcceptEncoding, "identity;q=0, br;q=0.5, gzip;q=0.9")
+
+	res := NewResponse(httptest.NewRecorder(), req)
+
+	if got := res.Negotiate("gzip", "br"); got != "gzip" {
+		t.Fatalf("Negotiate() = %q, want %q", got, "gzip")
+	}
+}
+
+func TestResponseNegotiateWithoutRequest(t *testing.T) {
+	rec := httptest.NewRecorder()
+	res := &Response{w: rec, rw: rec}
+	if got := res.Negotiate("gzip"); got != "" {
+		t.Fatalf("Negotiate() = %q, want \"\" when req is nil", got)
+	}
+}
+
+// TestResponseCompressionThroughRespond drives Negotiate + respond (the
+// single-shot body path) through a real gzip encoder and checks both the
+// headers WriteHeader sets and that the emitted bytes actually decompress
+// back to the original body.
+func TestResponseCompressionThroughRespond(t *testing.T) {
+	RegisterEncoder("gzip", 5, newGzipEncoder)
+
+	body := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog, ", 8))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderAcceptEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	res := NewResponse(rec, req)
+
+	res.Negotiate("gzip")
+	if err := res.respond(http.StatusOK, body); err != nil {
+		t.Fatalf("respond: %v", err)
+	}
+
+	if got := rec.Header().Get(HeaderContentEncoding); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get(HeaderContentLength); got != "" {
+		t.Fatalf("Content-Length should be stripped when compressing, got %q", got)
+	}
+	if got := rec.Header().Get(HeaderVary); got != HeaderAcceptEncoding {
+		t.Fatalf("Vary = %q, want %q", got, HeaderAcceptEncoding)
+	}
+
+	if got := decodeGzip(t, rec.Body.Bytes()); string(got) != string(body) {
+		t.Fatalf("decompressed body = %q, want %q", got, body)
+	}
+}
+
+// TestResponseCompressionThroughDirectWrite covers the streaming path this
+// request's title promises: WriteHeader followed by repeated direct Write
+// calls with no respond() in between (e.g. an SSE/long-poll handler), with
+// the handler calling Close once it's done writing. It fails if the gzip
+// stream is left unclosed (truncated footer/CRC).
+func TestResponseCompressionThroughDirectWrite(t *testing.T) {
+	RegisterEncoder("gzip", 5, newGzipEncoder)
+
+	chunks := []string{"first chunk, ", "second chunk, ", "third and final chunk"}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderAcceptEncoding, "gzip")
+	rec := httptest.NewRecorder()
+	res := NewResponse(rec, req)
+
+	res.Negotiate("gzip")
+	res.WriteHeader(http.StatusOK)
+	for _, c := range chunks {
+		if _, err := res.Write([]byte(c)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := res.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := strings.Join(chunks, "")
+	if got := decodeGzip(t, rec.Body.Bytes()); string(got) != want {
+		t.Fatalf("decompressed body = %q, want %q", got, want)
+	}
+}
+
+func newGzipEncoder(w io.Writer, level int) io.WriteCloser {
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return gzip.NewWriter(w)
+	}
+	return gw
+}
+
+func decodeGzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("gzip read: %v", err)
+	}
+	return out
+}